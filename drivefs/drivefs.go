@@ -0,0 +1,634 @@
+// Package drivefs exposes a Google Drive vault, reached through the
+// obsidian-gdrive-sync-plugin proxy server, as a standard io/fs.FS.
+//
+// Drive has no native filepath: every path component is resolved by a
+// files.list query against a parent folder ID. Resolving a deep path like
+// /Vault/Notes/foo.md naively costs one round trip per segment. FS keeps an
+// in-memory cache of previously resolved paths (and their siblings, fetched
+// for free in the same files.list call) so repeated opens of the same vault
+// rarely touch the network.
+package drivefs
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"net/url"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// folderMimeType is the Drive mime type that marks a file resource as a
+// folder rather than a regular file.
+const folderMimeType = "application/vnd.google-apps.folder"
+
+const (
+	// dirCacheTTL bounds how long a cached directory listing is trusted
+	// before ReadDir/Open re-list it from Drive.
+	dirCacheTTL = 30 * time.Second
+	// fileCacheTTL bounds how long a cached file/folder's own metadata
+	// (id, mime type, modTime, size) is trusted.
+	fileCacheTTL = 5 * time.Minute
+)
+
+// fileEntry is a cached Drive file or folder, keyed by its resolved vault
+// path in FS.cache.
+type fileEntry struct {
+	fileID   string
+	mimeType string
+	modTime  time.Time
+	size     int64
+	cachedAt time.Time
+
+	// children maps child name -> child's cleaned vault path. Populated
+	// only once this entry's directory contents have been fully listed;
+	// nil means "unknown, ask Drive".
+	children         map[string]string
+	childrenCachedAt time.Time
+}
+
+func (e *fileEntry) isDir() bool {
+	return e.mimeType == folderMimeType
+}
+
+func (e *fileEntry) expired() bool {
+	return time.Since(e.cachedAt) > fileCacheTTL
+}
+
+// driveFile mirrors the subset of the Drive v3 files resource this package
+// needs.
+type driveFile struct {
+	ID           string `json:"id"`
+	Name         string `json:"name"`
+	MimeType     string `json:"mimeType"`
+	ModifiedTime string `json:"modifiedTime"`
+	Size         string `json:"size"`
+}
+
+type driveFileList struct {
+	Files []driveFile `json:"files"`
+}
+
+// FS wraps a single Drive vault, proxied through the oauth proxy server's
+// /api/{provider}/ routes, as an fs.FS. It implements fs.FS, fs.ReadDirFS
+// and fs.StatFS for reads, plus OpenFile/Mkdir/Remove for writes.
+//
+// Every request FS builds - the files.list query, the folder mime-type
+// check, alt=media reads, the multipart upload/files writes - is Drive v3
+// shaped. provider only picks which path prefix those requests go out
+// under; it does not make FS work against Dropbox, OneDrive, or any other
+// Provider's native API. Point FS only at a provider that speaks Drive v3
+// under /api/{provider}/ (in practice, "google").
+type FS struct {
+	baseURL     string
+	provider    string
+	secretKey   string
+	accessToken string
+	rootID      string
+	httpClient  *http.Client
+
+	mu    sync.Mutex
+	cache map[string]*fileEntry
+}
+
+// New returns an FS rooted at the Drive folder identified by rootID,
+// reached through the proxy server running at baseURL (e.g.
+// "http://localhost:8080"). secretKey and accessToken are forwarded as the
+// X-Secret-Key and X-Access-Token headers the proxy expects. provider is
+// the proxy route prefix to use (see the FS doc comment on why this must
+// be a Drive v3-speaking provider, i.e. "google" in practice); an empty
+// string defaults to "google".
+func New(baseURL, secretKey, accessToken, rootID, provider string) *FS {
+	if provider == "" {
+		provider = "google"
+	}
+	return &FS{
+		baseURL:     strings.TrimSuffix(baseURL, "/"),
+		provider:    provider,
+		secretKey:   secretKey,
+		accessToken: accessToken,
+		rootID:      rootID,
+		httpClient:  &http.Client{Timeout: 30 * time.Second},
+		cache:       make(map[string]*fileEntry),
+	}
+}
+
+// apiURL builds a URL under the proxy's /api/{provider}/ passthrough for
+// apiPath (e.g. "files/abc123").
+func (f *FS) apiURL(apiPath string) string {
+	return f.baseURL + "/api/" + f.provider + "/" + apiPath
+}
+
+// Open implements fs.FS.
+func (f *FS) Open(name string) (fs.File, error) {
+	entry, err := f.resolve(name)
+	if err != nil {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: err}
+	}
+
+	if entry.isDir() {
+		dirEntries, err := f.listDirEntries(name, entry)
+		if err != nil {
+			return nil, &fs.PathError{Op: "open", Path: name, Err: err}
+		}
+		return &dirHandle{info: f.fileInfo(path.Base(name), entry), entries: dirEntries}, nil
+	}
+
+	return f.openFileForRead(name, entry)
+}
+
+// ReadDir implements fs.ReadDirFS.
+func (f *FS) ReadDir(name string) ([]fs.DirEntry, error) {
+	entry, err := f.resolve(name)
+	if err != nil {
+		return nil, &fs.PathError{Op: "readdir", Path: name, Err: err}
+	}
+	if !entry.isDir() {
+		return nil, &fs.PathError{Op: "readdir", Path: name, Err: fmt.Errorf("not a directory")}
+	}
+	return f.listDirEntries(name, entry)
+}
+
+// Stat implements fs.StatFS.
+func (f *FS) Stat(name string) (fs.FileInfo, error) {
+	entry, err := f.resolve(name)
+	if err != nil {
+		return nil, &fs.PathError{Op: "stat", Path: name, Err: err}
+	}
+	return f.fileInfo(path.Base(name), entry), nil
+}
+
+// resolve validates name against the fs.FS contract and walks it segment by
+// segment, serving each hop from cache and falling back to a Drive
+// files.list call (which also populates the cache with the resolved
+// entry's siblings) on miss.
+func (f *FS) resolve(name string) (*fileEntry, error) {
+	if !fs.ValidPath(name) {
+		return nil, fs.ErrInvalid
+	}
+	if name == "." {
+		return f.rootEntry(), nil
+	}
+	return f.resolveClean(path.Clean("/" + name)[1:])
+}
+
+// resolveClean walks an already-cleaned path (as produced by path.Clean,
+// with "" denoting the vault root) segment by segment. It's split out from
+// resolve so internal callers that already hold a cleaned parent path -
+// which is "" for a root-level parent, a value fs.ValidPath rejects - don't
+// have to fake up a name that would pass the public fs.FS validation again.
+func (f *FS) resolveClean(clean string) (*fileEntry, error) {
+	if clean == "" {
+		return f.rootEntry(), nil
+	}
+
+	if entry := f.cacheGet(clean); entry != nil {
+		return entry, nil
+	}
+
+	parentPath := path.Dir(clean)
+	if parentPath == "." {
+		parentPath = ""
+	}
+
+	parent, err := f.resolveClean(parentPath)
+	if err != nil {
+		return nil, err
+	}
+	if !parent.isDir() {
+		return nil, fs.ErrNotExist
+	}
+
+	if entry := f.cacheGet(clean); entry != nil {
+		// Another caller listed parent's children while the recursive
+		// resolveClean() call above was resolving parent.
+		return entry, nil
+	}
+
+	if err := f.listChildrenInto(parentPath, parent); err != nil {
+		return nil, err
+	}
+
+	entry := f.cacheGet(clean)
+	if entry == nil {
+		return nil, fs.ErrNotExist
+	}
+	return entry, nil
+}
+
+func (f *FS) rootEntry() *fileEntry {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if entry, ok := f.cache[""]; ok && !entry.expired() {
+		return entry
+	}
+
+	entry := &fileEntry{
+		fileID:   f.rootID,
+		mimeType: folderMimeType,
+		cachedAt: time.Now(),
+	}
+	f.cache[""] = entry
+	return entry
+}
+
+func (f *FS) cacheGet(cleanPath string) *fileEntry {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	entry, ok := f.cache[cleanPath]
+	if !ok || entry.expired() {
+		return nil
+	}
+	return entry
+}
+
+// listChildrenInto lists every child of parent (whose cleaned path is
+// parentPath), caching each child under parentPath/childName and recording
+// the full set on parent.children.
+func (f *FS) listChildrenInto(parentPath string, parent *fileEntry) error {
+	files, err := f.driveListChildren(parent.fileID)
+	if err != nil {
+		return err
+	}
+
+	children := make(map[string]string, len(files))
+
+	f.mu.Lock()
+	for _, df := range files {
+		childPath := df.Name
+		if parentPath != "" {
+			childPath = parentPath + "/" + df.Name
+		}
+		children[df.Name] = childPath
+		f.cache[childPath] = driveFileToEntry(df)
+	}
+	parent.children = children
+	parent.childrenCachedAt = time.Now()
+	f.mu.Unlock()
+
+	return nil
+}
+
+func driveFileToEntry(df driveFile) *fileEntry {
+	modTime, _ := time.Parse(time.RFC3339, df.ModifiedTime)
+	size, _ := strconv.ParseInt(df.Size, 10, 64)
+	return &fileEntry{
+		fileID:   df.ID,
+		mimeType: df.MimeType,
+		modTime:  modTime,
+		size:     size,
+		cachedAt: time.Now(),
+	}
+}
+
+// driveListChildren performs a single files.list call for every direct
+// child of parentID.
+func (f *FS) driveListChildren(parentID string) ([]driveFile, error) {
+	q := url.Values{}
+	q.Set("q", fmt.Sprintf("'%s' in parents and trashed = false", parentID))
+	q.Set("fields", "files(id,name,mimeType,modifiedTime,size)")
+
+	var list driveFileList
+	if err := f.driveGet("files", q, &list); err != nil {
+		return nil, err
+	}
+	return list.Files, nil
+}
+
+func (f *FS) listDirEntries(name string, entry *fileEntry) ([]fs.DirEntry, error) {
+	clean := path.Clean("/" + name)[1:]
+
+	children, expired := f.childrenSnapshot(entry)
+	if expired {
+		if err := f.listChildrenInto(clean, entry); err != nil {
+			return nil, err
+		}
+		children, _ = f.childrenSnapshot(entry)
+	}
+
+	dirEntries := make([]fs.DirEntry, 0, len(children))
+	for childName, childPath := range children {
+		childEntry := f.cacheGet(childPath)
+		if childEntry == nil {
+			continue
+		}
+		dirEntries = append(dirEntries, dirEntryWrapper{f.fileInfo(childName, childEntry)})
+	}
+	return dirEntries, nil
+}
+
+// childrenSnapshot returns a copy of entry's children map plus whether it's
+// missing or past dirCacheTTL. It reads entry.children/childrenCachedAt
+// under f.mu, since listChildrenInto and invalidate mutate those same
+// fields under that lock.
+func (f *FS) childrenSnapshot(entry *fileEntry) (children map[string]string, expired bool) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if entry.children == nil || time.Since(entry.childrenCachedAt) > dirCacheTTL {
+		return nil, true
+	}
+	snapshot := make(map[string]string, len(entry.children))
+	for name, childPath := range entry.children {
+		snapshot[name] = childPath
+	}
+	return snapshot, false
+}
+
+func (f *FS) fileInfo(name string, entry *fileEntry) fs.FileInfo {
+	return fileInfo{name: name, entry: entry}
+}
+
+// driveGet issues an authenticated GET against the proxy's /api/{provider}/
+// passthrough and decodes the JSON response into out.
+func (f *FS) driveGet(apiPath string, q url.Values, out interface{}) error {
+	req, err := http.NewRequest(http.MethodGet, f.apiURL(apiPath)+"?"+q.Encode(), nil)
+	if err != nil {
+		return err
+	}
+	f.setAuthHeaders(req)
+
+	resp, err := f.httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(resp.Body)
+		return fmt.Errorf("drivefs: proxy returned %d: %s", resp.StatusCode, string(body))
+	}
+
+	return json.NewDecoder(resp.Body).Decode(out)
+}
+
+func (f *FS) setAuthHeaders(req *http.Request) {
+	req.Header.Set("X-Secret-Key", f.secretKey)
+	req.Header.Set("X-Access-Token", f.accessToken)
+}
+
+// invalidate drops the cached entry for name and forces its parent
+// directory's listing to be refetched on next use. Called after any write
+// through OpenFile, Mkdir or Remove.
+func (f *FS) invalidate(name string) {
+	clean := path.Clean("/" + name)[1:]
+	parentPath := path.Dir(clean)
+	if parentPath == "." {
+		parentPath = ""
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	delete(f.cache, clean)
+	if parent, ok := f.cache[parentPath]; ok {
+		parent.children = nil
+	}
+}
+
+// --- fs.FileInfo / fs.DirEntry -------------------------------------------------
+
+type fileInfo struct {
+	name  string
+	entry *fileEntry
+}
+
+func (i fileInfo) Name() string { return i.name }
+func (i fileInfo) Size() int64  { return i.entry.size }
+func (i fileInfo) Mode() fs.FileMode {
+	if i.entry.isDir() {
+		return fs.ModeDir | 0755
+	}
+	return 0644
+}
+func (i fileInfo) ModTime() time.Time { return i.entry.modTime }
+func (i fileInfo) IsDir() bool        { return i.entry.isDir() }
+func (i fileInfo) Sys() interface{}   { return i.entry }
+
+type dirEntryWrapper struct {
+	info fs.FileInfo
+}
+
+func (d dirEntryWrapper) Name() string               { return d.info.Name() }
+func (d dirEntryWrapper) IsDir() bool                { return d.info.IsDir() }
+func (d dirEntryWrapper) Type() fs.FileMode          { return d.info.Mode().Type() }
+func (d dirEntryWrapper) Info() (fs.FileInfo, error) { return d.info, nil }
+
+// --- fs.File implementations ---------------------------------------------------
+
+// dirHandle implements fs.ReadDirFile for an already-resolved directory.
+type dirHandle struct {
+	info    fs.FileInfo
+	entries []fs.DirEntry
+	offset  int
+}
+
+func (d *dirHandle) Stat() (fs.FileInfo, error) { return d.info, nil }
+func (d *dirHandle) Read([]byte) (int, error) {
+	return 0, fmt.Errorf("drivefs: %s is a directory", d.info.Name())
+}
+func (d *dirHandle) Close() error { return nil }
+
+func (d *dirHandle) ReadDir(n int) ([]fs.DirEntry, error) {
+	if n <= 0 {
+		rest := d.entries[d.offset:]
+		d.offset = len(d.entries)
+		return rest, nil
+	}
+
+	remaining := len(d.entries) - d.offset
+	if remaining == 0 {
+		return nil, io.EOF
+	}
+	if n > remaining {
+		n = remaining
+	}
+	batch := d.entries[d.offset : d.offset+n]
+	d.offset += n
+	return batch, nil
+}
+
+// readFileHandle implements fs.File for reading a Drive file's content.
+type readFileHandle struct {
+	info fs.FileInfo
+	body io.ReadCloser
+}
+
+func (h *readFileHandle) Stat() (fs.FileInfo, error) { return h.info, nil }
+func (h *readFileHandle) Read(p []byte) (int, error) { return h.body.Read(p) }
+func (h *readFileHandle) Close() error               { return h.body.Close() }
+
+func (f *FS) openFileForRead(name string, entry *fileEntry) (fs.File, error) {
+	req, err := http.NewRequest(http.MethodGet, f.apiURL("files/"+entry.fileID)+"?alt=media", nil)
+	if err != nil {
+		return nil, err
+	}
+	f.setAuthHeaders(req)
+
+	resp, err := f.httpClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		return nil, fmt.Errorf("drivefs: proxy returned %d fetching %s", resp.StatusCode, name)
+	}
+
+	return &readFileHandle{info: f.fileInfo(path.Base(name), entry), body: resp.Body}, nil
+}
+
+// --- writes ----------------------------------------------------------------
+
+// File is the write handle returned by OpenFile. Content is buffered in
+// memory and uploaded as a single multipart request on Close, matching how
+// the proxy's /api/{provider}/upload/ passthrough expects whole-file uploads.
+type File struct {
+	fsys     *FS
+	name     string
+	fileID   string // empty when creating a new file
+	parentID string
+	buf      bytes.Buffer
+}
+
+// OpenFile opens name for writing, creating it (and its Drive file ID) on
+// Close if it doesn't already exist. Only write-oriented flags (O_WRONLY,
+// O_RDWR, O_CREATE, O_TRUNC) are meaningful; drivefs has no in-place append.
+func (f *FS) OpenFile(name string, flag int, perm fs.FileMode) (*File, error) {
+	clean := path.Clean("/" + name)[1:]
+	parentPath := path.Dir(clean)
+	if parentPath == "." {
+		parentPath = ""
+	}
+
+	parent, err := f.resolveClean(parentPath)
+	if err != nil {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: err}
+	}
+	if !parent.isDir() {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: fmt.Errorf("parent is not a directory")}
+	}
+
+	file := &File{fsys: f, name: name, parentID: parent.fileID}
+	if entry := f.cacheGet(clean); entry != nil {
+		file.fileID = entry.fileID
+	}
+	return file, nil
+}
+
+func (fh *File) Write(p []byte) (int, error) { return fh.buf.Write(p) }
+
+// Close uploads the buffered content, creating the Drive file if it didn't
+// already exist, and invalidates the parent directory's cached listing.
+func (fh *File) Close() error {
+	f := fh.fsys
+
+	var targetURL string
+	var method string
+	if fh.fileID == "" {
+		targetURL = f.apiURL("upload/files") + "?uploadType=media"
+		method = http.MethodPost
+	} else {
+		targetURL = f.apiURL("upload/files/"+fh.fileID) + "?uploadType=media"
+		method = http.MethodPatch
+	}
+
+	req, err := http.NewRequest(method, targetURL, bytes.NewReader(fh.buf.Bytes()))
+	if err != nil {
+		return err
+	}
+	f.setAuthHeaders(req)
+
+	resp, err := f.httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(resp.Body)
+		return fmt.Errorf("drivefs: upload of %s returned %d: %s", fh.name, resp.StatusCode, string(body))
+	}
+
+	f.invalidate(fh.name)
+	return nil
+}
+
+// Mkdir creates a Drive folder at name.
+func (f *FS) Mkdir(name string, perm fs.FileMode) error {
+	clean := path.Clean("/" + name)[1:]
+	parentPath := path.Dir(clean)
+	if parentPath == "." {
+		parentPath = ""
+	}
+
+	parent, err := f.resolveClean(parentPath)
+	if err != nil {
+		return &fs.PathError{Op: "mkdir", Path: name, Err: err}
+	}
+
+	body, err := json.Marshal(map[string]interface{}{
+		"name":     path.Base(clean),
+		"mimeType": folderMimeType,
+		"parents":  []string{parent.fileID},
+	})
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequest(http.MethodPost, f.apiURL("files"), bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	f.setAuthHeaders(req)
+
+	resp, err := f.httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		respBody, _ := io.ReadAll(resp.Body)
+		return fmt.Errorf("drivefs: mkdir %s returned %d: %s", name, resp.StatusCode, string(respBody))
+	}
+
+	f.invalidate(name)
+	return nil
+}
+
+// Remove deletes the Drive file or folder at name.
+func (f *FS) Remove(name string) error {
+	entry, err := f.resolve(name)
+	if err != nil {
+		return &fs.PathError{Op: "remove", Path: name, Err: err}
+	}
+
+	req, err := http.NewRequest(http.MethodDelete, f.apiURL("files/"+entry.fileID), nil)
+	if err != nil {
+		return err
+	}
+	f.setAuthHeaders(req)
+
+	resp, err := f.httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusNoContent {
+		body, _ := io.ReadAll(resp.Body)
+		return fmt.Errorf("drivefs: remove %s returned %d: %s", name, resp.StatusCode, string(body))
+	}
+
+	f.invalidate(name)
+	return nil
+}
@@ -0,0 +1,166 @@
+package drivefs
+
+import (
+	"encoding/json"
+	"io/fs"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+)
+
+// fakeDrive serves minimal Drive v3 files.list/upload responses keyed by
+// parent folder ID, and counts files.list calls so tests can assert on
+// cache hits vs. misses.
+type fakeDrive struct {
+	childrenByParent map[string][]driveFile
+	listCalls        int32
+}
+
+func (d *fakeDrive) handler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.Method == http.MethodGet && r.URL.Path == "/api/google/files":
+			atomic.AddInt32(&d.listCalls, 1)
+			parentID := parentIDFromQuery(r.URL.Query().Get("q"))
+			json.NewEncoder(w).Encode(driveFileList{Files: d.childrenByParent[parentID]})
+		case (r.Method == http.MethodPost || r.Method == http.MethodPatch) &&
+			strings.HasPrefix(r.URL.Path, "/api/google/upload/files"):
+			w.WriteHeader(http.StatusOK)
+		default:
+			http.NotFound(w, r)
+		}
+	}
+}
+
+// parentIDFromQuery pulls PARENT_ID out of a driveListChildren query string
+// of the form "'PARENT_ID' in parents and trashed = false".
+func parentIDFromQuery(q string) string {
+	start := strings.Index(q, "'")
+	end := strings.LastIndex(q, "'")
+	if start < 0 || end <= start {
+		return ""
+	}
+	return q[start+1 : end]
+}
+
+func TestResolveRoot(t *testing.T) {
+	fs := New("http://example.invalid", "secret", "token", "root-id", "google")
+
+	entry, err := fs.resolve(".")
+	if err != nil {
+		t.Fatalf("resolve(\".\") returned error: %v", err)
+	}
+	if entry.fileID != "root-id" || !entry.isDir() {
+		t.Fatalf("resolve(\".\") = %+v, want the root folder", entry)
+	}
+}
+
+func TestResolveRejectsEmptyName(t *testing.T) {
+	fsys := New("http://example.invalid", "secret", "token", "root-id", "google")
+
+	if _, err := fsys.resolve(""); err != fs.ErrInvalid {
+		t.Fatalf("resolve(\"\") error = %v, want fs.ErrInvalid per the io/fs.FS contract", err)
+	}
+}
+
+func TestResolveCacheHitAndMiss(t *testing.T) {
+	drive := &fakeDrive{childrenByParent: map[string][]driveFile{
+		"root-id":  {{ID: "notes-id", Name: "Notes", MimeType: folderMimeType}},
+		"notes-id": {{ID: "foo-id", Name: "foo.md", MimeType: "text/markdown", Size: "12"}},
+	}}
+	srv := httptest.NewServer(drive.handler())
+	defer srv.Close()
+
+	fs := New(srv.URL, "secret", "token", "root-id", "google")
+
+	entry, err := fs.resolve("Notes/foo.md")
+	if err != nil {
+		t.Fatalf("resolve: %v", err)
+	}
+	if entry.fileID != "foo-id" {
+		t.Fatalf("resolve(Notes/foo.md).fileID = %q, want foo-id", entry.fileID)
+	}
+	coldCalls := atomic.LoadInt32(&drive.listCalls)
+	if coldCalls != 2 {
+		t.Fatalf("resolving a 2-deep path cold made %d files.list calls, want 2", coldCalls)
+	}
+
+	if _, err := fs.resolve("Notes/foo.md"); err != nil {
+		t.Fatalf("second resolve: %v", err)
+	}
+	if got := atomic.LoadInt32(&drive.listCalls); got != coldCalls {
+		t.Fatalf("resolving a cached path made %d more files.list calls, want 0", got-coldCalls)
+	}
+}
+
+func TestInvalidateAfterWrite(t *testing.T) {
+	drive := &fakeDrive{childrenByParent: map[string][]driveFile{
+		"root-id":  {{ID: "notes-id", Name: "Notes", MimeType: folderMimeType}},
+		"notes-id": {{ID: "foo-id", Name: "foo.md", MimeType: "text/markdown", Size: "12"}},
+	}}
+	srv := httptest.NewServer(drive.handler())
+	defer srv.Close()
+
+	fs := New(srv.URL, "secret", "token", "root-id", "google")
+
+	if _, err := fs.resolve("Notes/foo.md"); err != nil {
+		t.Fatalf("resolve: %v", err)
+	}
+	if entry := fs.cacheGet("Notes/foo.md"); entry == nil {
+		t.Fatalf("expected Notes/foo.md to be cached after resolve")
+	}
+
+	file, err := fs.OpenFile("Notes/foo.md", os.O_WRONLY, 0644)
+	if err != nil {
+		t.Fatalf("OpenFile: %v", err)
+	}
+	file.Write([]byte("updated"))
+	if err := file.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+
+	if entry := fs.cacheGet("Notes/foo.md"); entry != nil {
+		t.Fatalf("expected Notes/foo.md to be evicted from cache after write, got %+v", entry)
+	}
+
+	parent := fs.cacheGet("Notes")
+	if parent == nil {
+		t.Fatalf("expected Notes to remain cached")
+	}
+	if parent.children != nil {
+		t.Fatalf("expected Notes's children listing to be invalidated after a write to one of its children")
+	}
+}
+
+// TestReadDirConcurrentWithInvalidate drives concurrent ReadDir and
+// invalidate calls against the same directory entry, under -race, to guard
+// against listDirEntries reading entry.children/childrenCachedAt outside
+// f.mu while invalidate mutates them under it.
+func TestReadDirConcurrentWithInvalidate(t *testing.T) {
+	drive := &fakeDrive{childrenByParent: map[string][]driveFile{
+		"root-id":  {{ID: "notes-id", Name: "Notes", MimeType: folderMimeType}},
+		"notes-id": {{ID: "foo-id", Name: "foo.md", MimeType: "text/markdown", Size: "12"}},
+	}}
+	srv := httptest.NewServer(drive.handler())
+	defer srv.Close()
+
+	fs := New(srv.URL, "secret", "token", "root-id", "google")
+
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			fs.ReadDir("Notes")
+		}()
+		go func() {
+			defer wg.Done()
+			fs.invalidate("Notes/foo.md")
+		}()
+	}
+	wg.Wait()
+}
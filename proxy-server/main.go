@@ -1,6 +1,7 @@
 package main
 
 import (
+	"bytes"
 	"context"
 	"crypto/rand"
 	"encoding/hex"
@@ -15,16 +16,28 @@ import (
 	"time"
 
 	"golang.org/x/oauth2"
-	"golang.org/x/oauth2/google"
 )
 
 // Configuration
 type Config struct {
-	Port         string `json:"port"`
-	ClientID     string `json:"client_id"`
-	ClientSecret string `json:"client_secret"`
-	RedirectURI  string `json:"redirect_uri"`
+	Port         string                `json:"port"`
+	ClientID     string                `json:"client_id"`
+	ClientSecret string                `json:"client_secret"`
+	RedirectURI  string                `json:"redirect_uri"`
 	SecretKeys   map[string]UserConfig `json:"secret_keys"`
+	SessionStore SessionStoreConfig    `json:"session_store,omitempty"`
+	Providers    []ProviderConfig      `json:"providers,omitempty"`
+
+	// GlobalRateLimit caps total requests/minute across all users, ahead of
+	// each user's own UserConfig.RateLimit, to protect shared provider
+	// quota. 0 disables it.
+	GlobalRateLimit int `json:"global_rate_limit,omitempty"`
+
+	// StateSigningKey is the HMAC key used to bind OAuth state values to a
+	// session+user. Set this explicitly when running multiple proxy
+	// instances behind a shared SessionStore; otherwise each instance
+	// generates its own random key at startup.
+	StateSigningKey string `json:"state_signing_key,omitempty"`
 }
 
 type UserConfig struct {
@@ -36,6 +49,7 @@ type UserConfig struct {
 // OAuth session management
 type AuthSession struct {
 	SessionID   string    `json:"session_id"`
+	Provider    string    `json:"provider"`
 	State       string    `json:"state"`
 	AuthURL     string    `json:"auth_url"`
 	Status      string    `json:"status"` // pending, completed, failed
@@ -44,14 +58,18 @@ type AuthSession struct {
 	ExpiresAt   int64     `json:"expires_at,omitempty"`
 	CreatedAt   time.Time `json:"created_at"`
 	UserID      string    `json:"user_id"`
+
+	// CodeVerifier is the PKCE code_verifier generated for this flow and
+	// redeemed against the authorization code in handleAuthCallback. It
+	// never leaves the server; no response struct exposes it.
+	CodeVerifier string `json:"code_verifier,omitempty"`
 }
 
 // Global variables
 var (
 	config       Config
-	oauthConfig  *oauth2.Config
-	authSessions = make(map[string]*AuthSession)
-	sessionMutex sync.RWMutex
+	providers    map[string]Provider
+	sessionStore SessionStore
 )
 
 // Response structures
@@ -73,21 +91,63 @@ type HealthResponse struct {
 	Timestamp int64  `json:"timestamp"`
 }
 
+type RefreshRequest struct {
+	SessionID    string `json:"session_id"`
+	RefreshToken string `json:"refresh_token"`
+}
+
+type RefreshResponse struct {
+	AccessToken string `json:"access_token"`
+	ExpiresAt   int64  `json:"expires_at"`
+}
+
+// refreshWindow is how far ahead of expiry the background refresher will
+// proactively redeem a refresh token. handleProviderAPI's 401 fallback does
+// not use it; it refreshes only after the provider rejects a token.
+const refreshWindow = 5 * time.Minute
+
+// sessionTTL bounds how long a pending OAuth session may be redeemed at
+// /auth/callback and how old a session can get before cleanupOldSessions
+// reaps it.
+const sessionTTL = 10 * time.Minute
+
 func main() {
 	// Load configuration
 	if err := loadConfig(); err != nil {
 		log.Fatal("Failed to load configuration:", err)
 	}
 
-	// Setup OAuth configuration
-	setupOAuth()
+	// Setup OAuth providers
+	if err := setupProviders(); err != nil {
+		log.Fatal("Failed to initialize OAuth providers:", err)
+	}
+
+	// Setup OAuth state signing
+	if err := setupStateSigningKey(); err != nil {
+		log.Fatal("Failed to initialize state signing key:", err)
+	}
+
+	// Setup session storage
+	store, err := newSessionStore(config.SessionStore)
+	if err != nil {
+		log.Fatal("Failed to initialize session store:", err)
+	}
+	sessionStore = store
+
+	// Setup rate limiting
+	setupRateLimiting(config.GlobalRateLimit)
 
 	// Setup HTTP routes
-	http.HandleFunc("/health", handleHealth)
-	http.HandleFunc("/auth/initiate", handleAuthInitiate)
-	http.HandleFunc("/auth/callback", handleAuthCallback)
+	http.HandleFunc("/health", withRateLimit(handleHealth))
+	http.HandleFunc("/auth/initiate/", withRateLimit(handleAuthInitiate))
+	http.HandleFunc("/auth/callback/", handleAuthCallback)
 	http.HandleFunc("/auth/status/", handleAuthStatus)
-	http.HandleFunc("/api/drive/", handleDriveAPI)
+	http.HandleFunc("/auth/refresh", handleAuthRefresh)
+	http.HandleFunc("/api/", withRateLimit(handleProviderAPI))
+
+	// Keep completed sessions' access tokens from going stale between
+	// client requests.
+	go backgroundTokenRefresher()
 
 	port := config.Port
 	if port == "" {
@@ -130,21 +190,6 @@ func loadConfig() error {
 	return nil
 }
 
-func setupOAuth() {
-	oauthConfig = &oauth2.Config{
-		ClientID:     config.ClientID,
-		ClientSecret: config.ClientSecret,
-		RedirectURL:  config.RedirectURI,
-		Scopes:       []string{"https://www.googleapis.com/auth/drive"},
-		Endpoint:     google.Endpoint,
-	}
-
-	if config.RedirectURI == "" {
-		// Default redirect URI for the proxy server
-		oauthConfig.RedirectURL = "http://localhost:8080/auth/callback"
-	}
-}
-
 func validateSecretKey(r *http.Request) (*UserConfig, error) {
 	secretKey := r.Header.Get("X-Secret-Key")
 	if secretKey == "" {
@@ -200,27 +245,51 @@ func handleAuthInitiate(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// Generate session
+	providerName := strings.TrimPrefix(r.URL.Path, "/auth/initiate/")
+	provider, ok := providers[providerName]
+	if !ok {
+		http.Error(w, "Unknown provider", http.StatusNotFound)
+		return
+	}
+
+	// Generate session, binding its state to this session+user via HMAC.
 	sessionID := generateSessionID()
-	state := generateSessionID()
+	state := generateState(sessionID, userConfig.UserID)
+
+	codeVerifier, err := generateCodeVerifier()
+	if err != nil {
+		log.Printf("Failed to generate PKCE code_verifier: %v", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	codeChallenge := codeChallengeS256(codeVerifier)
 
 	// Create OAuth URL
-	authURL := oauthConfig.AuthCodeURL(state, oauth2.AccessTypeOffline, oauth2.ApprovalForce)
+	authURL := provider.OAuthConfig().AuthCodeURL(state,
+		oauth2.AccessTypeOffline,
+		oauth2.ApprovalForce,
+		oauth2.SetAuthURLParam("code_challenge", codeChallenge),
+		oauth2.SetAuthURLParam("code_challenge_method", "S256"),
+	)
 
 	// Store session
 	session := &AuthSession{
-		SessionID: sessionID,
-		State:     state,
-		AuthURL:   authURL,
-		Status:    "pending",
-		CreatedAt: time.Now(),
-		UserID:    userConfig.UserID,
+		SessionID:    sessionID,
+		Provider:     providerName,
+		State:        state,
+		AuthURL:      authURL,
+		Status:       "pending",
+		CreatedAt:    time.Now(),
+		UserID:       userConfig.UserID,
+		CodeVerifier: codeVerifier,
+	}
+
+	if err := sessionStore.Put(session); err != nil {
+		log.Printf("Failed to store session %s: %v", sessionID, err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
 	}
 
-	sessionMutex.Lock()
-	authSessions[sessionID] = session
-	sessionMutex.Unlock()
-
 	// Clean up old sessions (older than 10 minutes)
 	go cleanupOldSessions()
 
@@ -239,6 +308,13 @@ func handleAuthCallback(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	providerName := strings.TrimPrefix(r.URL.Path, "/auth/callback/")
+	provider, ok := providers[providerName]
+	if !ok {
+		http.Error(w, "Unknown provider", http.StatusNotFound)
+		return
+	}
+
 	code := r.URL.Query().Get("code")
 	state := r.URL.Query().Get("state")
 
@@ -248,38 +324,53 @@ func handleAuthCallback(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// Find session by state
-	sessionMutex.Lock()
-	var targetSession *AuthSession
-	for _, session := range authSessions {
-		if session.State == state {
-			targetSession = session
-			break
-		}
+	targetSession, err := sessionStore.FindByState(state)
+	if err != nil || targetSession.Provider != providerName {
+		http.Error(w, "Invalid state parameter", http.StatusBadRequest)
+		return
 	}
-	sessionMutex.Unlock()
 
-	if targetSession == nil {
+	if !verifyState(targetSession, state) {
+		log.Printf("State HMAC mismatch for session %s", targetSession.SessionID)
 		http.Error(w, "Invalid state parameter", http.StatusBadRequest)
 		return
 	}
 
-	// Exchange code for token
+	// Reject replays: a session can only be redeemed once, and only within
+	// its TTL.
+	if targetSession.Status != "pending" {
+		http.Error(w, "Session already completed", http.StatusConflict)
+		return
+	}
+	if time.Since(targetSession.CreatedAt) > sessionTTL {
+		http.Error(w, "Session expired", http.StatusGone)
+		return
+	}
+
+	// Exchange code for token, redeeming the PKCE code_verifier generated
+	// at /auth/initiate alongside the code_challenge sent to the provider.
 	ctx := context.Background()
-	token, err := oauthConfig.Exchange(ctx, code)
+	token, err := provider.OAuthConfig().Exchange(ctx, code,
+		oauth2.SetAuthURLParam("code_verifier", targetSession.CodeVerifier),
+	)
 	if err != nil {
 		log.Printf("Token exchange failed: %v", err)
 		targetSession.Status = "failed"
+		sessionStore.Put(targetSession)
 		http.Error(w, "Token exchange failed", http.StatusInternalServerError)
 		return
 	}
 
 	// Update session with tokens
-	sessionMutex.Lock()
 	targetSession.Status = "completed"
 	targetSession.AccessToken = token.AccessToken
 	targetSession.RefreshToken = token.RefreshToken
 	targetSession.ExpiresAt = token.Expiry.Unix()
-	sessionMutex.Unlock()
+	if err := sessionStore.Put(targetSession); err != nil {
+		log.Printf("Failed to persist session %s: %v", targetSession.SessionID, err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
 
 	// Return success page
 	w.Header().Set("Content-Type", "text/html")
@@ -306,7 +397,8 @@ func handleAuthStatus(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// Validate secret key
-	if _, err := validateSecretKey(r); err != nil {
+	userConfig, err := validateSecretKey(r)
+	if err != nil {
 		http.Error(w, "Unauthorized", http.StatusUnauthorized)
 		return
 	}
@@ -318,11 +410,12 @@ func handleAuthStatus(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	sessionMutex.RLock()
-	session, exists := authSessions[sessionID]
-	sessionMutex.RUnlock()
-
-	if !exists {
+	session, err := sessionStore.Get(sessionID)
+	if err != nil {
+		http.Error(w, "Session not found", http.StatusNotFound)
+		return
+	}
+	if session.UserID != userConfig.UserID {
 		http.Error(w, "Session not found", http.StatusNotFound)
 		return
 	}
@@ -341,7 +434,12 @@ func handleAuthStatus(w http.ResponseWriter, r *http.Request) {
 	json.NewEncoder(w).Encode(response)
 }
 
-func handleDriveAPI(w http.ResponseWriter, r *http.Request) {
+func handleAuthRefresh(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
 	// Validate secret key
 	userConfig, err := validateSecretKey(r)
 	if err != nil {
@@ -349,61 +447,234 @@ func handleDriveAPI(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// Get access token from header
-	accessToken := r.Header.Get("X-Access-Token")
-	if accessToken == "" {
-		http.Error(w, "Missing access token", http.StatusBadRequest)
+	var req RefreshRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	session := findRefreshableSession(req.SessionID, req.RefreshToken)
+	if session == nil || session.UserID != userConfig.UserID {
+		http.Error(w, "Session not found", http.StatusNotFound)
+		return
+	}
+
+	token, err := refreshSessionToken(r.Context(), session)
+	if err != nil {
+		log.Printf("Token refresh failed for session %s: %v", session.SessionID, err)
+		http.Error(w, "Token refresh failed", http.StatusBadGateway)
 		return
 	}
 
-	// Extract API path
-	apiPath := strings.TrimPrefix(r.URL.Path, "/api/drive/")
-	
-	// Construct Google Drive API URL
-	var targetURL string
-	if strings.HasPrefix(apiPath, "upload/") {
-		targetURL = "https://www.googleapis.com/upload/drive/v3/" + strings.TrimPrefix(apiPath, "upload/")
-	} else {
-		targetURL = "https://www.googleapis.com/drive/v3/" + apiPath
+	response := RefreshResponse{
+		AccessToken: token.AccessToken,
+		ExpiresAt:   token.Expiry.Unix(),
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
+
+// findRefreshableSession looks up a session by ID, falling back to a linear
+// scan by refresh token when the caller only has the token on hand.
+func findRefreshableSession(sessionID, refreshToken string) *AuthSession {
+	if sessionID != "" {
+		session, err := sessionStore.Get(sessionID)
+		if err != nil {
+			return nil
+		}
+		return session
+	}
+
+	if refreshToken == "" {
+		return nil
 	}
 
-	// Add query parameters
-	if r.URL.RawQuery != "" {
-		targetURL += "?" + r.URL.RawQuery
+	var found *AuthSession
+	sessionStore.Iterate(func(session *AuthSession) bool {
+		if session.RefreshToken == refreshToken {
+			found = session
+			return false
+		}
+		return true
+	})
+	return found
+}
+
+// sessionRefreshLocks holds one mutex per session ID, keyed lazily like
+// userLimiters in ratelimit.go. A mutex embedded on *AuthSession only
+// serializes refreshes when every caller shares the same pointer, which
+// MemoryStore happens to return but BoltStore and RedisStore don't: both
+// json.Unmarshal a fresh AuthSession on every Get/Iterate, so two callers
+// would each lock their own zeroed mutex and redeem the same refresh token
+// concurrently. Locking by session ID here works regardless of the
+// SessionStore backend, but only within this process: it does not protect
+// two proxy instances sharing the same Bolt/Redis store from redeeming the
+// same refresh token at once. Multi-instance deployments need a store-level
+// lock (e.g. Redis SETNX) to close that gap.
+var sessionRefreshLocks = struct {
+	mu      sync.Mutex
+	entries map[string]*sync.Mutex
+}{entries: make(map[string]*sync.Mutex)}
+
+func sessionRefreshLock(sessionID string) *sync.Mutex {
+	sessionRefreshLocks.mu.Lock()
+	defer sessionRefreshLocks.mu.Unlock()
+
+	lock, ok := sessionRefreshLocks.entries[sessionID]
+	if !ok {
+		lock = &sync.Mutex{}
+		sessionRefreshLocks.entries[sessionID] = lock
+	}
+	return lock
+}
+
+// refreshSessionToken redeems session's refresh token for a fresh access
+// token and persists the result. It holds sessionRefreshLock(session's ID)
+// for the duration so the background refresher and an inline 401 retry
+// never redeem the same refresh token concurrently, then re-reads the
+// session from the store before refreshing in case another caller already
+// refreshed it while this one was waiting on the lock.
+func refreshSessionToken(ctx context.Context, session *AuthSession) (*oauth2.Token, error) {
+	lock := sessionRefreshLock(session.SessionID)
+	lock.Lock()
+	defer lock.Unlock()
+
+	current, err := sessionStore.Get(session.SessionID)
+	if err != nil {
+		return nil, fmt.Errorf("reload session before refresh: %w", err)
+	}
+	session = current
+
+	provider, ok := providers[session.Provider]
+	if !ok {
+		return nil, fmt.Errorf("unknown provider %q for session %s", session.Provider, session.SessionID)
+	}
+
+	refreshToken := session.RefreshToken
+	if refreshToken == "" {
+		return nil, fmt.Errorf("session has no refresh token")
 	}
 
-	// Create proxy request
-	proxyReq, err := http.NewRequest(r.Method, targetURL, r.Body)
+	tokenSource := provider.OAuthConfig().TokenSource(ctx, &oauth2.Token{RefreshToken: refreshToken})
+	token, err := tokenSource.Token()
 	if err != nil {
-		http.Error(w, "Failed to create proxy request", http.StatusInternalServerError)
-		return
+		return nil, err
 	}
 
-	// Copy headers (except our custom ones)
-	for name, values := range r.Header {
-		if !strings.HasPrefix(name, "X-") {
-			for _, value := range values {
-				proxyReq.Header.Add(name, value)
+	session.AccessToken = token.AccessToken
+	if token.RefreshToken != "" {
+		session.RefreshToken = token.RefreshToken
+	}
+	session.ExpiresAt = token.Expiry.Unix()
+
+	if err := sessionStore.Put(session); err != nil {
+		return nil, fmt.Errorf("persist refreshed session: %w", err)
+	}
+
+	return token, nil
+}
+
+// backgroundTokenRefresher wakes periodically and pre-refreshes completed
+// sessions whose access token is about to expire, so clients rarely hit a
+// stale token.
+func backgroundTokenRefresher() {
+	ticker := time.NewTicker(1 * time.Minute)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		var expiring []*AuthSession
+		cutoff := time.Now().Add(refreshWindow).Unix()
+		sessionStore.Iterate(func(session *AuthSession) bool {
+			if session.Status == "completed" && session.RefreshToken != "" && session.ExpiresAt <= cutoff {
+				expiring = append(expiring, session)
+			}
+			return true
+		})
+
+		for _, session := range expiring {
+			if _, err := refreshSessionToken(context.Background(), session); err != nil {
+				log.Printf("Background refresh failed for session %s: %v", session.SessionID, err)
 			}
 		}
 	}
+}
 
-	// Set authorization header
-	proxyReq.Header.Set("Authorization", "Bearer "+accessToken)
+func handleProviderAPI(w http.ResponseWriter, r *http.Request) {
+	// Validate secret key
+	userConfig, err := validateSecretKey(r)
+	if err != nil {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
 
-	// Log the request for debugging
-	log.Printf("Proxying request for user %s: %s %s", userConfig.UserID, r.Method, targetURL)
+	// Extract provider name and the remainder of the path, e.g.
+	// /api/google/files/abc123 -> provider "google", apiPath "files/abc123".
+	rest := strings.TrimPrefix(r.URL.Path, "/api/")
+	providerName, apiPath, _ := strings.Cut(rest, "/")
+	provider, ok := providers[providerName]
+	if !ok {
+		http.Error(w, "Unknown provider", http.StatusNotFound)
+		return
+	}
+
+	// Get access token from header
+	accessToken := r.Header.Get("X-Access-Token")
+	if accessToken == "" {
+		http.Error(w, "Missing access token", http.StatusBadRequest)
+		return
+	}
+
+	// Optional session ID, used to transparently refresh a momentarily
+	// expired access token instead of surfacing a 401 to the plugin.
+	sessionID := r.Header.Get("X-Session-ID")
+
+	// Buffer the body so it can be replayed if the first attempt comes
+	// back 401 and we need to retry with a refreshed token.
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, "Failed to read request body", http.StatusInternalServerError)
+		return
+	}
+
+	targetURL, err := provider.ProxyURL(apiPath, r.URL.Query())
+	if err != nil {
+		http.Error(w, "Failed to build upstream request", http.StatusInternalServerError)
+		return
+	}
 
-	// Make the request
 	client := &http.Client{Timeout: 30 * time.Second}
-	resp, err := client.Do(proxyReq)
+
+	resp, err := proxyProviderRequest(client, r, provider, targetURL, accessToken, body)
 	if err != nil {
 		log.Printf("Proxy request failed: %v", err)
 		http.Error(w, "Proxy request failed", http.StatusBadGateway)
 		return
 	}
+
+	if resp.StatusCode == http.StatusUnauthorized && sessionID != "" {
+		resp.Body.Close()
+
+		session, err := sessionStore.Get(sessionID)
+		if err == nil && session.RefreshToken != "" {
+			token, refreshErr := refreshSessionToken(r.Context(), session)
+			if refreshErr != nil {
+				log.Printf("Token refresh on 401 failed for session %s: %v", sessionID, refreshErr)
+			} else {
+				resp, err = proxyProviderRequest(client, r, provider, targetURL, token.AccessToken, body)
+				if err != nil {
+					log.Printf("Proxy retry failed: %v", err)
+					http.Error(w, "Proxy request failed", http.StatusBadGateway)
+					return
+				}
+			}
+		}
+	}
 	defer resp.Body.Close()
 
+	// Log the request for debugging
+	log.Printf("Proxying request for user %s: %s %s", userConfig.UserID, r.Method, targetURL)
+
 	// Copy response headers
 	for name, values := range resp.Header {
 		for _, value := range values {
@@ -418,14 +689,37 @@ func handleDriveAPI(w http.ResponseWriter, r *http.Request) {
 	io.Copy(w, resp.Body)
 }
 
-func cleanupOldSessions() {
-	sessionMutex.Lock()
-	defer sessionMutex.Unlock()
+// proxyProviderRequest builds and issues a single proxied request to a
+// provider's API with the given access token, replaying the buffered
+// request body and giving the provider a chance to adjust the request for
+// its own conventions.
+func proxyProviderRequest(client *http.Client, r *http.Request, provider Provider, targetURL, accessToken string, body []byte) (*http.Response, error) {
+	proxyReq, err := http.NewRequest(r.Method, targetURL, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
 
-	cutoff := time.Now().Add(-10 * time.Minute)
-	for sessionID, session := range authSessions {
-		if session.CreatedAt.Before(cutoff) {
-			delete(authSessions, sessionID)
+	// Copy headers (except our custom ones)
+	for name, values := range r.Header {
+		if !strings.HasPrefix(name, "X-") {
+			for _, value := range values {
+				proxyReq.Header.Add(name, value)
+			}
 		}
 	}
+
+	// Set authorization header
+	proxyReq.Header.Set("Authorization", "Bearer "+accessToken)
+
+	if err := provider.RewriteRequest(proxyReq); err != nil {
+		return nil, err
+	}
+
+	return client.Do(proxyReq)
+}
+
+func cleanupOldSessions() {
+	if err := sessionStore.GC(sessionTTL); err != nil {
+		log.Printf("Session GC failed: %v", err)
+	}
 }
\ No newline at end of file
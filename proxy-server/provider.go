@@ -0,0 +1,208 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"golang.org/x/oauth2"
+	"golang.org/x/oauth2/google"
+)
+
+// Provider abstracts over a storage backend's OAuth config and API shape so
+// the proxy can front Google Drive, Dropbox, OneDrive, or anything else
+// that speaks OAuth2 + a REST API, instead of hard-coding Drive everywhere.
+type Provider interface {
+	// Name is the provider's key in routes like /auth/initiate/{name} and
+	// /api/{name}/....
+	Name() string
+	OAuthConfig() *oauth2.Config
+	// ProxyURL builds the upstream request URL for a path under
+	// /api/{name}/ (e.g. "files/abc123") plus the original query string.
+	ProxyURL(apiPath string, q url.Values) (string, error)
+	// RewriteRequest lets a provider adjust the outgoing request beyond
+	// the generic Bearer Authorization header the caller already set.
+	RewriteRequest(req *http.Request) error
+}
+
+// ProviderConfig configures one Provider instance. Type selects which
+// built-in provider to construct.
+type ProviderConfig struct {
+	Type         string   `json:"type"` // "google", "dropbox", "onedrive"
+	ClientID     string   `json:"client_id"`
+	ClientSecret string   `json:"client_secret"`
+	Scopes       []string `json:"scopes,omitempty"`
+	RedirectURI  string   `json:"redirect_uri"`
+}
+
+// setupProviders builds the providers map from config.Providers. For
+// backward compatibility with single-tenant Google Drive configs, an empty
+// Providers list falls back to treating the top-level ClientID/ClientSecret/
+// RedirectURI fields as an implicit "google" provider.
+func setupProviders() error {
+	cfgs := config.Providers
+	if len(cfgs) == 0 && config.ClientID != "" {
+		cfgs = []ProviderConfig{{
+			Type:         "google",
+			ClientID:     config.ClientID,
+			ClientSecret: config.ClientSecret,
+			RedirectURI:  config.RedirectURI,
+		}}
+	}
+
+	built, err := registerProviders(cfgs)
+	if err != nil {
+		return err
+	}
+	providers = built
+	return nil
+}
+
+func registerProviders(cfgs []ProviderConfig) (map[string]Provider, error) {
+	built := make(map[string]Provider, len(cfgs))
+	for _, cfg := range cfgs {
+		provider, err := buildProvider(cfg)
+		if err != nil {
+			return nil, err
+		}
+		built[provider.Name()] = provider
+	}
+	return built, nil
+}
+
+func buildProvider(cfg ProviderConfig) (Provider, error) {
+	switch cfg.Type {
+	case "google":
+		return newGoogleDriveProvider(cfg), nil
+	case "dropbox":
+		return newDropboxProvider(cfg), nil
+	case "onedrive":
+		return newOneDriveProvider(cfg), nil
+	default:
+		return nil, fmt.Errorf("unknown provider type %q", cfg.Type)
+	}
+}
+
+func redirectURIOrDefault(cfg ProviderConfig, name string) string {
+	if cfg.RedirectURI != "" {
+		return cfg.RedirectURI
+	}
+	return "http://localhost:8080/auth/callback/" + name
+}
+
+func scopesOrDefault(cfg ProviderConfig, defaults []string) []string {
+	if len(cfg.Scopes) > 0 {
+		return cfg.Scopes
+	}
+	return defaults
+}
+
+// --- Google Drive ------------------------------------------------------------
+
+type googleDriveProvider struct {
+	oauthConfig *oauth2.Config
+}
+
+func newGoogleDriveProvider(cfg ProviderConfig) *googleDriveProvider {
+	return &googleDriveProvider{
+		oauthConfig: &oauth2.Config{
+			ClientID:     cfg.ClientID,
+			ClientSecret: cfg.ClientSecret,
+			RedirectURL:  redirectURIOrDefault(cfg, "google"),
+			Scopes:       scopesOrDefault(cfg, []string{"https://www.googleapis.com/auth/drive"}),
+			Endpoint:     google.Endpoint,
+		},
+	}
+}
+
+func (p *googleDriveProvider) Name() string                       { return "google" }
+func (p *googleDriveProvider) OAuthConfig() *oauth2.Config        { return p.oauthConfig }
+func (p *googleDriveProvider) RewriteRequest(*http.Request) error { return nil }
+
+func (p *googleDriveProvider) ProxyURL(apiPath string, q url.Values) (string, error) {
+	var targetURL string
+	if strings.HasPrefix(apiPath, "upload/") {
+		targetURL = "https://www.googleapis.com/upload/drive/v3/" + strings.TrimPrefix(apiPath, "upload/")
+	} else {
+		targetURL = "https://www.googleapis.com/drive/v3/" + apiPath
+	}
+	if encoded := q.Encode(); encoded != "" {
+		targetURL += "?" + encoded
+	}
+	return targetURL, nil
+}
+
+// --- Dropbox -------------------------------------------------------------------
+
+type dropboxProvider struct {
+	oauthConfig *oauth2.Config
+}
+
+func newDropboxProvider(cfg ProviderConfig) *dropboxProvider {
+	return &dropboxProvider{
+		oauthConfig: &oauth2.Config{
+			ClientID:     cfg.ClientID,
+			ClientSecret: cfg.ClientSecret,
+			RedirectURL:  redirectURIOrDefault(cfg, "dropbox"),
+			Scopes:       scopesOrDefault(cfg, []string{"files.content.read", "files.content.write"}),
+			Endpoint: oauth2.Endpoint{
+				AuthURL:  "https://www.dropbox.com/oauth2/authorize",
+				TokenURL: "https://api.dropbox.com/oauth2/token",
+			},
+		},
+	}
+}
+
+func (p *dropboxProvider) Name() string                { return "dropbox" }
+func (p *dropboxProvider) OAuthConfig() *oauth2.Config { return p.oauthConfig }
+
+func (p *dropboxProvider) ProxyURL(apiPath string, q url.Values) (string, error) {
+	targetURL := "https://api.dropboxapi.com/2/" + apiPath
+	if encoded := q.Encode(); encoded != "" {
+		targetURL += "?" + encoded
+	}
+	return targetURL, nil
+}
+
+// RewriteRequest defaults to the JSON content type Dropbox's RPC-style
+// endpoints expect when the plugin didn't already set one.
+func (p *dropboxProvider) RewriteRequest(req *http.Request) error {
+	if req.Header.Get("Content-Type") == "" {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	return nil
+}
+
+// --- OneDrive / Microsoft Graph ------------------------------------------------
+
+type oneDriveProvider struct {
+	oauthConfig *oauth2.Config
+}
+
+func newOneDriveProvider(cfg ProviderConfig) *oneDriveProvider {
+	return &oneDriveProvider{
+		oauthConfig: &oauth2.Config{
+			ClientID:     cfg.ClientID,
+			ClientSecret: cfg.ClientSecret,
+			RedirectURL:  redirectURIOrDefault(cfg, "onedrive"),
+			Scopes:       scopesOrDefault(cfg, []string{"Files.ReadWrite", "offline_access"}),
+			Endpoint: oauth2.Endpoint{
+				AuthURL:  "https://login.microsoftonline.com/common/oauth2/v2.0/authorize",
+				TokenURL: "https://login.microsoftonline.com/common/oauth2/v2.0/token",
+			},
+		},
+	}
+}
+
+func (p *oneDriveProvider) Name() string                       { return "onedrive" }
+func (p *oneDriveProvider) OAuthConfig() *oauth2.Config        { return p.oauthConfig }
+func (p *oneDriveProvider) RewriteRequest(*http.Request) error { return nil }
+
+func (p *oneDriveProvider) ProxyURL(apiPath string, q url.Values) (string, error) {
+	targetURL := "https://graph.microsoft.com/v1.0/me/drive/" + apiPath
+	if encoded := q.Encode(); encoded != "" {
+		targetURL += "?" + encoded
+	}
+	return targetURL, nil
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"log"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+const (
+	// defaultBurst is the minimum burst size granted to each per-user
+	// limiter, so a very low per-minute quota still allows a small handful
+	// of requests in quick succession rather than trickling one at a time.
+	// The global limiter's burst is GlobalRateLimit itself, without this
+	// floor.
+	defaultBurst = 10
+
+	// idleLimiterExpiry and limiterGCInterval bound how long a per-user
+	// limiter sticks around after its last request, so userLimiters
+	// doesn't grow without bound as secret keys come and go.
+	idleLimiterExpiry = 30 * time.Minute
+	limiterGCInterval = 10 * time.Minute
+)
+
+// globalLimiter protects Google's per-project quota from being exhausted
+// by the sum of every user's traffic. nil means no global cap is
+// configured.
+var globalLimiter *rate.Limiter
+
+// userLimiters holds one token bucket per secret key, created lazily on
+// first use and reaped once idle.
+var userLimiters = struct {
+	mu      sync.Mutex
+	entries map[string]*userLimiterEntry
+}{entries: make(map[string]*userLimiterEntry)}
+
+type userLimiterEntry struct {
+	limiter  *rate.Limiter
+	lastSeen time.Time
+}
+
+// setupRateLimiting configures the global limiter (if globalRateLimit > 0)
+// and starts the goroutine that garbage-collects idle per-user limiters.
+func setupRateLimiting(globalRateLimit int) {
+	if globalRateLimit > 0 {
+		globalLimiter = newRateLimiter(globalRateLimit, globalRateLimit)
+	}
+	go gcIdleLimiters()
+}
+
+func newRateLimiter(requestsPerMinute, burst int) *rate.Limiter {
+	if burst < 1 {
+		burst = 1
+	}
+	return rate.NewLimiter(rate.Limit(float64(requestsPerMinute)/60.0), burst)
+}
+
+// perUserLimiter returns the token bucket for key, creating one sized to
+// requestsPerMinute (interpreted as requests/minute, per UserConfig.RateLimit)
+// on first use.
+func perUserLimiter(key string, requestsPerMinute int) *rate.Limiter {
+	userLimiters.mu.Lock()
+	defer userLimiters.mu.Unlock()
+
+	entry, ok := userLimiters.entries[key]
+	if !ok {
+		if requestsPerMinute <= 0 {
+			requestsPerMinute = 60
+		}
+		burst := requestsPerMinute
+		if burst < defaultBurst {
+			burst = defaultBurst
+		}
+		entry = &userLimiterEntry{limiter: newRateLimiter(requestsPerMinute, burst)}
+		userLimiters.entries[key] = entry
+	}
+	entry.lastSeen = time.Now()
+	return entry.limiter
+}
+
+func gcIdleLimiters() {
+	ticker := time.NewTicker(limiterGCInterval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		userLimiters.mu.Lock()
+		cutoff := time.Now().Add(-idleLimiterExpiry)
+		for key, entry := range userLimiters.entries {
+			if entry.lastSeen.Before(cutoff) {
+				delete(userLimiters.entries, key)
+			}
+		}
+		userLimiters.mu.Unlock()
+	}
+}
+
+// withRateLimit enforces the global bucket first, then the per-user bucket
+// for the caller's secret key, before handing off to next.
+func withRateLimit(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if globalLimiter != nil && !globalLimiter.Allow() {
+			writeRateLimited(w, globalLimiter)
+			log.Printf("Global rate limit exceeded: %s %s", r.Method, r.URL.Path)
+			return
+		}
+
+		secretKey := r.Header.Get("X-Secret-Key")
+		if secretKey != "" {
+			if userConfig, ok := config.SecretKeys[secretKey]; ok {
+				limiter := perUserLimiter(secretKey, userConfig.RateLimit)
+				if !limiter.Allow() {
+					writeRateLimited(w, limiter)
+					log.Printf("Rate limit exceeded for user %s: %s %s", userConfig.UserID, r.Method, r.URL.Path)
+					return
+				}
+			}
+		}
+
+		next(w, r)
+	}
+}
+
+func writeRateLimited(w http.ResponseWriter, limiter *rate.Limiter) {
+	remaining := int(limiter.Tokens())
+	if remaining < 0 {
+		remaining = 0
+	}
+	w.Header().Set("Retry-After", "60")
+	w.Header().Set("X-RateLimit-Remaining", strconv.Itoa(remaining))
+	http.Error(w, "Too Many Requests", http.StatusTooManyRequests)
+}
@@ -0,0 +1,166 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// errSessionNotFound is returned by every SessionStore implementation when
+// a lookup misses, so call sites can branch on it regardless of backend.
+var errSessionNotFound = errors.New("session not found")
+
+// SessionStore persists AuthSessions so OAuth state and refresh tokens
+// survive a proxy restart and, for the bolt/redis backends, can be shared
+// across instances.
+type SessionStore interface {
+	Get(sessionID string) (*AuthSession, error)
+	Put(session *AuthSession) error
+	Delete(sessionID string) error
+	// FindByState looks up a session by its OAuth state parameter. It must
+	// be O(1) via a secondary index rather than a scan over every session.
+	FindByState(state string) (*AuthSession, error)
+	GC(olderThan time.Duration) error
+	// Iterate calls fn for every stored session, stopping early if fn
+	// returns false.
+	Iterate(fn func(*AuthSession) bool) error
+}
+
+// SessionStoreConfig selects and configures a SessionStore backend.
+// Type defaults to "memory" when empty.
+type SessionStoreConfig struct {
+	Type string `json:"type"` // "memory" (default), "bolt", "redis"
+
+	// Bolt
+	Path          string `json:"path,omitempty"`
+	EncryptionKey string `json:"encryption_key,omitempty"` // base64-encoded AES-256 key
+
+	// Redis
+	RedisAddr     string `json:"redis_addr,omitempty"`
+	RedisPassword string `json:"redis_password,omitempty"`
+	RedisDB       int    `json:"redis_db,omitempty"`
+	TTLSeconds    int    `json:"ttl_seconds,omitempty"`
+}
+
+// newSessionStore builds the SessionStore selected by cfg.Type.
+func newSessionStore(cfg SessionStoreConfig) (SessionStore, error) {
+	switch cfg.Type {
+	case "", "memory":
+		return NewMemoryStore(), nil
+	case "bolt":
+		if cfg.Path == "" {
+			return nil, fmt.Errorf("session store: bolt requires a path")
+		}
+		key, err := decodeEncryptionKey(cfg.EncryptionKey)
+		if err != nil {
+			return nil, err
+		}
+		return NewBoltStore(cfg.Path, key)
+	case "redis":
+		if cfg.RedisAddr == "" {
+			return nil, fmt.Errorf("session store: redis requires redis_addr")
+		}
+		ttl := time.Duration(cfg.TTLSeconds) * time.Second
+		if ttl <= 0 {
+			ttl = 10 * time.Minute
+		}
+		return NewRedisStore(cfg.RedisAddr, cfg.RedisPassword, cfg.RedisDB, ttl), nil
+	default:
+		return nil, fmt.Errorf("session store: unknown type %q", cfg.Type)
+	}
+}
+
+// MemoryStore is the original in-process SessionStore: a map guarded by a
+// mutex, plus a state -> session ID index so FindByState doesn't have to
+// scan every session.
+type MemoryStore struct {
+	mu       sync.RWMutex
+	sessions map[string]*AuthSession
+	byState  map[string]string
+}
+
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{
+		sessions: make(map[string]*AuthSession),
+		byState:  make(map[string]string),
+	}
+}
+
+func (m *MemoryStore) Get(sessionID string) (*AuthSession, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	session, ok := m.sessions[sessionID]
+	if !ok {
+		return nil, errSessionNotFound
+	}
+	return session, nil
+}
+
+func (m *MemoryStore) Put(session *AuthSession) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.sessions[session.SessionID] = session
+	if session.State != "" {
+		m.byState[session.State] = session.SessionID
+	}
+	return nil
+}
+
+func (m *MemoryStore) Delete(sessionID string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if session, ok := m.sessions[sessionID]; ok {
+		delete(m.byState, session.State)
+	}
+	delete(m.sessions, sessionID)
+	return nil
+}
+
+func (m *MemoryStore) FindByState(state string) (*AuthSession, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	sessionID, ok := m.byState[state]
+	if !ok {
+		return nil, errSessionNotFound
+	}
+	session, ok := m.sessions[sessionID]
+	if !ok {
+		return nil, errSessionNotFound
+	}
+	return session, nil
+}
+
+func (m *MemoryStore) GC(olderThan time.Duration) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	cutoff := time.Now().Add(-olderThan)
+	for sessionID, session := range m.sessions {
+		if session.CreatedAt.Before(cutoff) {
+			delete(m.byState, session.State)
+			delete(m.sessions, sessionID)
+		}
+	}
+	return nil
+}
+
+func (m *MemoryStore) Iterate(fn func(*AuthSession) bool) error {
+	m.mu.RLock()
+	sessions := make([]*AuthSession, 0, len(m.sessions))
+	for _, session := range m.sessions {
+		sessions = append(sessions, session)
+	}
+	m.mu.RUnlock()
+
+	for _, session := range sessions {
+		if !fn(session) {
+			break
+		}
+	}
+	return nil
+}
@@ -0,0 +1,224 @@
+package main
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"go.etcd.io/bbolt"
+)
+
+var (
+	sessionsBucket = []byte("sessions")
+	statesBucket   = []byte("states")
+)
+
+// BoltStore persists AuthSessions to a local bbolt file. Records are
+// encrypted with AES-256-GCM before being written, since a session carries
+// a live Drive refresh token. A secondary "states" bucket maps OAuth state
+// -> session ID so FindByState is a single key lookup instead of a scan.
+type BoltStore struct {
+	db  *bbolt.DB
+	gcm cipher.AEAD
+}
+
+func NewBoltStore(path string, encryptionKey []byte) (*BoltStore, error) {
+	db, err := bbolt.Open(path, 0600, &bbolt.Options{Timeout: 5 * time.Second})
+	if err != nil {
+		return nil, fmt.Errorf("session store: open bolt db: %w", err)
+	}
+
+	err = db.Update(func(tx *bbolt.Tx) error {
+		if _, err := tx.CreateBucketIfNotExists(sessionsBucket); err != nil {
+			return err
+		}
+		_, err := tx.CreateBucketIfNotExists(statesBucket)
+		return err
+	})
+	if err != nil {
+		db.Close()
+		return nil, fmt.Errorf("session store: init bolt buckets: %w", err)
+	}
+
+	block, err := aes.NewCipher(encryptionKey)
+	if err != nil {
+		db.Close()
+		return nil, fmt.Errorf("session store: bolt cipher: %w", err)
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		db.Close()
+		return nil, fmt.Errorf("session store: bolt cipher: %w", err)
+	}
+
+	return &BoltStore{db: db, gcm: gcm}, nil
+}
+
+func decodeEncryptionKey(encoded string) ([]byte, error) {
+	if encoded == "" {
+		return nil, fmt.Errorf("session store: bolt requires encryption_key (base64 AES-256 key)")
+	}
+	key, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return nil, fmt.Errorf("session store: invalid encryption_key: %w", err)
+	}
+	if len(key) != 32 {
+		return nil, fmt.Errorf("session store: encryption_key must decode to 32 bytes (AES-256), got %d", len(key))
+	}
+	return key, nil
+}
+
+func (b *BoltStore) encrypt(session *AuthSession) ([]byte, error) {
+	plaintext, err := json.Marshal(session)
+	if err != nil {
+		return nil, err
+	}
+
+	nonce := make([]byte, b.gcm.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	return b.gcm.Seal(nonce, nonce, plaintext, nil), nil
+}
+
+func (b *BoltStore) decrypt(data []byte) (*AuthSession, error) {
+	nonceSize := b.gcm.NonceSize()
+	if len(data) < nonceSize {
+		return nil, fmt.Errorf("session store: ciphertext too short")
+	}
+
+	nonce, ciphertext := data[:nonceSize], data[nonceSize:]
+	plaintext, err := b.gcm.Open(nil, nonce, ciphertext, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	var session AuthSession
+	if err := json.Unmarshal(plaintext, &session); err != nil {
+		return nil, err
+	}
+	return &session, nil
+}
+
+func (b *BoltStore) Get(sessionID string) (*AuthSession, error) {
+	var session *AuthSession
+	err := b.db.View(func(tx *bbolt.Tx) error {
+		data := tx.Bucket(sessionsBucket).Get([]byte(sessionID))
+		if data == nil {
+			return errSessionNotFound
+		}
+		s, err := b.decrypt(data)
+		if err != nil {
+			return err
+		}
+		session = s
+		return nil
+	})
+	return session, err
+}
+
+func (b *BoltStore) Put(session *AuthSession) error {
+	data, err := b.encrypt(session)
+	if err != nil {
+		return err
+	}
+
+	return b.db.Update(func(tx *bbolt.Tx) error {
+		if err := tx.Bucket(sessionsBucket).Put([]byte(session.SessionID), data); err != nil {
+			return err
+		}
+		if session.State == "" {
+			return nil
+		}
+		return tx.Bucket(statesBucket).Put([]byte(session.State), []byte(session.SessionID))
+	})
+}
+
+func (b *BoltStore) Delete(sessionID string) error {
+	return b.db.Update(func(tx *bbolt.Tx) error {
+		sessions := tx.Bucket(sessionsBucket)
+		if data := sessions.Get([]byte(sessionID)); data != nil {
+			if session, err := b.decrypt(data); err == nil && session.State != "" {
+				tx.Bucket(statesBucket).Delete([]byte(session.State))
+			}
+		}
+		return sessions.Delete([]byte(sessionID))
+	})
+}
+
+func (b *BoltStore) FindByState(state string) (*AuthSession, error) {
+	var session *AuthSession
+	err := b.db.View(func(tx *bbolt.Tx) error {
+		sessionID := tx.Bucket(statesBucket).Get([]byte(state))
+		if sessionID == nil {
+			return errSessionNotFound
+		}
+		data := tx.Bucket(sessionsBucket).Get(sessionID)
+		if data == nil {
+			return errSessionNotFound
+		}
+		s, err := b.decrypt(data)
+		if err != nil {
+			return err
+		}
+		session = s
+		return nil
+	})
+	return session, err
+}
+
+func (b *BoltStore) GC(olderThan time.Duration) error {
+	cutoff := time.Now().Add(-olderThan)
+
+	var expiredIDs [][]byte
+	err := b.db.View(func(tx *bbolt.Tx) error {
+		c := tx.Bucket(sessionsBucket).Cursor()
+		for k, v := c.First(); k != nil; k, v = c.Next() {
+			session, err := b.decrypt(v)
+			if err != nil {
+				continue
+			}
+			if session.CreatedAt.Before(cutoff) {
+				expiredIDs = append(expiredIDs, append([]byte(nil), k...))
+			}
+		}
+		return nil
+	})
+	if err != nil || len(expiredIDs) == 0 {
+		return err
+	}
+
+	return b.db.Update(func(tx *bbolt.Tx) error {
+		sessions := tx.Bucket(sessionsBucket)
+		states := tx.Bucket(statesBucket)
+		for _, id := range expiredIDs {
+			if data := sessions.Get(id); data != nil {
+				if session, err := b.decrypt(data); err == nil && session.State != "" {
+					states.Delete([]byte(session.State))
+				}
+			}
+			sessions.Delete(id)
+		}
+		return nil
+	})
+}
+
+func (b *BoltStore) Iterate(fn func(*AuthSession) bool) error {
+	return b.db.View(func(tx *bbolt.Tx) error {
+		c := tx.Bucket(sessionsBucket).Cursor()
+		for k, v := c.First(); k != nil; k, v = c.Next() {
+			session, err := b.decrypt(v)
+			if err != nil {
+				continue
+			}
+			if !fn(session) {
+				break
+			}
+		}
+		return nil
+	})
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// RedisStore persists AuthSessions in Redis so they can be shared across
+// proxy instances. Each session is stored under session:<id> with a TTL;
+// state:<state> -> <id> is a secondary index so FindByState is a single
+// GET rather than a scan. Expiry is handled entirely by Redis key TTLs, so
+// GC is a no-op.
+type RedisStore struct {
+	client *redis.Client
+	ttl    time.Duration
+}
+
+func NewRedisStore(addr, password string, db int, ttl time.Duration) *RedisStore {
+	return &RedisStore{
+		client: redis.NewClient(&redis.Options{
+			Addr:     addr,
+			Password: password,
+			DB:       db,
+		}),
+		ttl: ttl,
+	}
+}
+
+func sessionKey(sessionID string) string { return "session:" + sessionID }
+func stateKey(state string) string       { return "state:" + state }
+
+func (r *RedisStore) Get(sessionID string) (*AuthSession, error) {
+	ctx := context.Background()
+
+	data, err := r.client.Get(ctx, sessionKey(sessionID)).Bytes()
+	if err == redis.Nil {
+		return nil, errSessionNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var session AuthSession
+	if err := json.Unmarshal(data, &session); err != nil {
+		return nil, err
+	}
+	return &session, nil
+}
+
+func (r *RedisStore) Put(session *AuthSession) error {
+	ctx := context.Background()
+
+	data, err := json.Marshal(session)
+	if err != nil {
+		return err
+	}
+
+	pipe := r.client.TxPipeline()
+	pipe.Set(ctx, sessionKey(session.SessionID), data, r.ttl)
+	if session.State != "" {
+		pipe.Set(ctx, stateKey(session.State), session.SessionID, r.ttl)
+	}
+	_, err = pipe.Exec(ctx)
+	return err
+}
+
+func (r *RedisStore) Delete(sessionID string) error {
+	ctx := context.Background()
+
+	session, err := r.Get(sessionID)
+	if err != nil && err != errSessionNotFound {
+		return err
+	}
+
+	pipe := r.client.TxPipeline()
+	pipe.Del(ctx, sessionKey(sessionID))
+	if session != nil && session.State != "" {
+		pipe.Del(ctx, stateKey(session.State))
+	}
+	_, err = pipe.Exec(ctx)
+	return err
+}
+
+func (r *RedisStore) FindByState(state string) (*AuthSession, error) {
+	ctx := context.Background()
+
+	sessionID, err := r.client.Get(ctx, stateKey(state)).Result()
+	if err == redis.Nil {
+		return nil, errSessionNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return r.Get(sessionID)
+}
+
+// GC is a no-op: session and state keys expire on their own via Redis TTL.
+func (r *RedisStore) GC(olderThan time.Duration) error {
+	return nil
+}
+
+func (r *RedisStore) Iterate(fn func(*AuthSession) bool) error {
+	ctx := context.Background()
+
+	iter := r.client.Scan(ctx, 0, "session:*", 0).Iterator()
+	for iter.Next(ctx) {
+		data, err := r.client.Get(ctx, iter.Val()).Bytes()
+		if err != nil {
+			continue
+		}
+		var session AuthSession
+		if err := json.Unmarshal(data, &session); err != nil {
+			continue
+		}
+		if !fn(&session) {
+			break
+		}
+	}
+	return iter.Err()
+}